@@ -0,0 +1,222 @@
+/*
+Copyright © 2020 Red Hat, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package conf exposes the configuration of the smart proxy, loaded from a
+// config file and overridable via environment variables.
+package conf
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	envPrefix = "INSIGHTS_RESULTS_SMART_PROXY_"
+)
+
+// ServerConfiguration represents configuration for the HTTP(s) server
+type ServerConfiguration struct {
+	Address     string `mapstructure:"address" toml:"address"`
+	APIPrefix   string `mapstructure:"api_prefix" toml:"api_prefix"`
+	APISpecFile string `mapstructure:"api_spec_file" toml:"api_spec_file"`
+	Debug       bool   `mapstructure:"debug" toml:"debug"`
+	UseHTTPS    bool   `mapstructure:"use_https" toml:"use_https"`
+}
+
+// ServicesConfiguration represents configuration of the downstream services
+// that the smart proxy forwards requests to
+type ServicesConfiguration struct {
+	AggregatorBaseEndpoint string `mapstructure:"aggregator_base_endpoint" toml:"aggregator_base_endpoint"`
+	ContentBaseEndpoint    string `mapstructure:"content_base_endpoint" toml:"content_base_endpoint"`
+}
+
+// CircuitBreakerUpstreamConfiguration configures the rate limiter and
+// circuit breaker guarding a single upstream (aggregator or content)
+type CircuitBreakerUpstreamConfiguration struct {
+	// RateLimitRPS is the number of requests per second allowed through the
+	// token-bucket rate limiter for this upstream. 0 disables rate limiting.
+	RateLimitRPS int `mapstructure:"rate_limit_rps" toml:"rate_limit_rps"`
+	// RateLimitBurst is the token-bucket burst size
+	RateLimitBurst int `mapstructure:"rate_limit_burst" toml:"rate_limit_burst"`
+	// FailureRatioThreshold trips the breaker once this fraction of the
+	// requests counted since the breaker last closed have failed
+	FailureRatioThreshold float64 `mapstructure:"failure_ratio_threshold" toml:"failure_ratio_threshold"`
+	// MinRequestCount is the minimum number of requests counted since the
+	// breaker last closed before the failure ratio is evaluated
+	MinRequestCount int `mapstructure:"min_request_count" toml:"min_request_count"`
+	// OpenStateCooldownSeconds is how long the breaker stays open before
+	// moving to half-open
+	OpenStateCooldownSeconds int `mapstructure:"open_state_cooldown_seconds" toml:"open_state_cooldown_seconds"`
+	// HalfOpenProbeCount is how many successful requests while half-open
+	// close the breaker again; the first failure while half-open re-opens
+	// it. The number of requests let through while half-open is not limited.
+	HalfOpenProbeCount int `mapstructure:"half_open_probe_count" toml:"half_open_probe_count"`
+}
+
+// CircuitBreakerConfiguration configures the per-upstream rate limiters and
+// circuit breakers that guard calls made from proxyTo
+type CircuitBreakerConfiguration struct {
+	Aggregator CircuitBreakerUpstreamConfiguration `mapstructure:"aggregator" toml:"aggregator"`
+	Content    CircuitBreakerUpstreamConfiguration `mapstructure:"content" toml:"content"`
+}
+
+// CacheConfiguration configures the response caching middleware that sits
+// in front of the report and content proxy endpoints
+type CacheConfiguration struct {
+	// Backend selects the ResponseCache implementation: "memory" or "redis"
+	Backend string `mapstructure:"backend" toml:"backend"`
+	// LRUSize is the maximum number of entries kept by the in-memory backend
+	LRUSize int `mapstructure:"lru_size" toml:"lru_size"`
+	// RedisAddress is the host:port of the Redis backend
+	RedisAddress string `mapstructure:"redis_address" toml:"redis_address"`
+	// RedisPassword authenticates against the Redis backend, if set
+	RedisPassword string `mapstructure:"redis_password" toml:"redis_password"`
+	// RedisDB selects the Redis logical database
+	RedisDB int `mapstructure:"redis_db" toml:"redis_db"`
+	// DefaultTTLSeconds is used for endpoint patterns without an explicit
+	// entry in EndpointTTLSeconds
+	DefaultTTLSeconds int `mapstructure:"default_ttl_seconds" toml:"default_ttl_seconds"`
+	// EndpointTTLSeconds overrides DefaultTTLSeconds per endpoint pattern,
+	// e.g. "report/{organization}/{cluster}": 60
+	EndpointTTLSeconds map[string]int `mapstructure:"endpoint_ttl_seconds" toml:"endpoint_ttl_seconds"`
+	// StaleWhileRevalidateSeconds is how long a stale cache entry may still
+	// be served while a fresh copy is fetched in the background
+	StaleWhileRevalidateSeconds int `mapstructure:"stale_while_revalidate_seconds" toml:"stale_while_revalidate_seconds"`
+}
+
+// EgressRule describes a single allowed downstream destination and the
+// policy (timeouts, retries, header handling) applied to requests routed
+// to it
+type EgressRule struct {
+	// Name identifies the rule; routes in addEndpointsToRouter bind to it
+	// by name instead of using a bare base URL
+	Name string `mapstructure:"name" toml:"name"`
+	// Host is the allowed upstream host
+	Host string `mapstructure:"host" toml:"host"`
+	// Port is the allowed upstream port
+	Port int `mapstructure:"port" toml:"port"`
+	// Protocol is "http" or "https"
+	Protocol string `mapstructure:"protocol" toml:"protocol"`
+	// AllowedPaths is the list of path prefixes reachable through this rule
+	AllowedPaths []string `mapstructure:"allowed_paths" toml:"allowed_paths"`
+	// TimeoutSeconds bounds a single attempt against this upstream
+	TimeoutSeconds int `mapstructure:"timeout" toml:"timeout"`
+	// Retries is how many additional attempts are made for the methods
+	// listed in RetryOnMethods after the first one fails
+	Retries int `mapstructure:"retries" toml:"retries"`
+	// RetryOnMethods lists the HTTP methods eligible for retry, e.g. GET, PUT
+	RetryOnMethods []string `mapstructure:"retry_on" toml:"retry_on"`
+	// StripHeaders lists inbound request headers removed before forwarding,
+	// e.g. "Authorization" to prevent credential leakage downstream
+	StripHeaders []string `mapstructure:"strip_headers" toml:"strip_headers"`
+	// AddHeaders are added to the forwarded request
+	AddHeaders map[string]string `mapstructure:"add_headers" toml:"add_headers"`
+}
+
+// EgressConfiguration is the allow-list of downstream destinations
+// proxyTo is permitted to forward requests to
+type EgressConfiguration struct {
+	Rules []EgressRule `mapstructure:"rules" toml:"rules"`
+}
+
+// TracingConfiguration configures OpenTelemetry distributed tracing across
+// proxied requests
+type TracingConfiguration struct {
+	// Enabled turns on the OTLP tracer provider and the otelhttp middleware
+	Enabled bool `mapstructure:"enabled" toml:"enabled"`
+	// Endpoint is the OTLP collector endpoint, e.g. "otel-collector:4318"
+	Endpoint string `mapstructure:"endpoint" toml:"endpoint"`
+	// SampleRatio is the fraction of requests sampled, between 0 and 1
+	SampleRatio float64 `mapstructure:"sample_ratio" toml:"sample_ratio"`
+	// ServiceName identifies this service in the trace backend
+	ServiceName string `mapstructure:"service_name" toml:"service_name"`
+}
+
+// ConfigStruct is the root configuration structure, built up from the
+// sections below
+type ConfigStruct struct {
+	Server         ServerConfiguration         `mapstructure:"server" toml:"server"`
+	Services       ServicesConfiguration       `mapstructure:"services" toml:"services"`
+	CircuitBreaker CircuitBreakerConfiguration `mapstructure:"circuit_breaker" toml:"circuit_breaker"`
+	Cache          CacheConfiguration          `mapstructure:"cache" toml:"cache"`
+	Egress         EgressConfiguration         `mapstructure:"egress" toml:"egress"`
+	Tracing        TracingConfiguration        `mapstructure:"tracing" toml:"tracing"`
+}
+
+// Config is the global configuration for the smart proxy, populated by
+// LoadConfiguration
+var Config ConfigStruct
+
+// LoadConfiguration loads configuration from the file specified by
+// configFileName, overridden by environment variables prefixed with
+// INSIGHTS_RESULTS_SMART_PROXY_
+func LoadConfiguration(configFileName string) error {
+	viper.SetConfigName(configFileName)
+	viper.AddConfigPath(".")
+
+	viper.AutomaticEnv()
+	viper.SetEnvPrefix(envPrefix)
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+
+	err := viper.ReadInConfig()
+	if _, isNotFoundError := err.(viper.ConfigFileNotFoundError); !isNotFoundError && err != nil {
+		return fmt.Errorf("fatal error config file: %s", err)
+	}
+
+	if err := viper.Unmarshal(&Config); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetServerConfiguration returns the server configuration part of the
+// loaded configuration
+func GetServerConfiguration() ServerConfiguration {
+	return Config.Server
+}
+
+// GetServicesConfiguration returns the services configuration part of the
+// loaded configuration
+func GetServicesConfiguration() ServicesConfiguration {
+	return Config.Services
+}
+
+// GetCircuitBreakerConfiguration returns the circuit breaker and rate
+// limiter configuration part of the loaded configuration
+func GetCircuitBreakerConfiguration() CircuitBreakerConfiguration {
+	return Config.CircuitBreaker
+}
+
+// GetCacheConfiguration returns the response cache configuration part of
+// the loaded configuration
+func GetCacheConfiguration() CacheConfiguration {
+	return Config.Cache
+}
+
+// GetEgressConfiguration returns the egress allow-list configuration part
+// of the loaded configuration
+func GetEgressConfiguration() EgressConfiguration {
+	return Config.Egress
+}
+
+// GetTracingConfiguration returns the OpenTelemetry tracing configuration
+// part of the loaded configuration
+func GetTracingConfiguration() TracingConfiguration {
+	return Config.Tracing
+}
@@ -0,0 +1,396 @@
+// Copyright 2020 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/RedHatInsights/insights-results-smart-proxy/conf"
+)
+
+var (
+	cacheHitsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "smart_proxy_cache_hits_total",
+		Help: "Total number of response cache hits, by endpoint pattern",
+	}, []string{"endpoint"})
+
+	cacheMissesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "smart_proxy_cache_misses_total",
+		Help: "Total number of response cache misses, by endpoint pattern",
+	}, []string{"endpoint"})
+)
+
+// CachedResponse is a single cached upstream response
+type CachedResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	ETag       string
+	StoredAt   time.Time
+	ExpiresAt  time.Time
+}
+
+// fresh reports whether the cached response is still within its TTL
+func (c *CachedResponse) fresh() bool {
+	return time.Now().Before(c.ExpiresAt)
+}
+
+// ResponseCache is the pluggable backend used by the response caching
+// middleware to store proxied responses
+type ResponseCache interface {
+	// Get returns the cached response for key, if present
+	Get(ctx context.Context, key string) (*CachedResponse, bool)
+	// Set stores resp under key; resp is fresh for the given ttl
+	Set(ctx context.Context, key string, resp *CachedResponse, ttl time.Duration)
+	// Delete removes every entry whose key matches pattern and returns how
+	// many entries were removed
+	Delete(ctx context.Context, pattern string) int
+}
+
+// cacheKey builds the response cache key from the endpoint pattern, method,
+// path and the request-scoped dimensions the cached response varies on. The
+// pattern is kept in plain text as a key prefix (rather than folded into
+// the hash) so DELETE {apiPrefix}cache/{pattern} can still match entries by
+// pattern after they have been stored.
+func cacheKey(pattern, method, path, org, cluster, principal string) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{method, path, org, cluster, principal}, "|")))
+	return pattern + "|" + hex.EncodeToString(sum[:])
+}
+
+// lruResponseCache is an in-memory, size-bounded ResponseCache
+type lruResponseCache struct {
+	mutex    sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List
+}
+
+type lruEntry struct {
+	key      string
+	response *CachedResponse
+}
+
+func newLRUResponseCache(capacity int) *lruResponseCache {
+	if capacity <= 0 {
+		capacity = 1024
+	}
+
+	return &lruResponseCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (c *lruResponseCache) Get(_ context.Context, key string) (*CachedResponse, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	c.order.MoveToFront(elem)
+	return elem.Value.(*lruEntry).response, true
+}
+
+func (c *lruResponseCache) Set(_ context.Context, key string, resp *CachedResponse, ttl time.Duration) {
+	resp.ExpiresAt = time.Now().Add(ttl)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*lruEntry).response = resp
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	elem := c.order.PushFront(&lruEntry{key: key, response: resp})
+	c.entries[key] = elem
+
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		if oldest == nil {
+			break
+		}
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+func (c *lruResponseCache) Delete(_ context.Context, pattern string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	removed := 0
+	for key, elem := range c.entries {
+		if !strings.Contains(key, pattern) {
+			continue
+		}
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		removed++
+	}
+
+	return removed
+}
+
+// redisResponseCache is a ResponseCache backed by Redis, used when multiple
+// smart-proxy instances need to share a cache
+type redisResponseCache struct {
+	client *redis.Client
+}
+
+func newRedisResponseCache(cfg conf.CacheConfiguration) *redisResponseCache {
+	return &redisResponseCache{
+		client: redis.NewClient(&redis.Options{
+			Addr:     cfg.RedisAddress,
+			Password: cfg.RedisPassword,
+			DB:       cfg.RedisDB,
+		}),
+	}
+}
+
+func (c *redisResponseCache) Get(ctx context.Context, key string) (*CachedResponse, bool) {
+	data, err := c.client.Get(ctx, key).Bytes()
+	if err != nil {
+		return nil, false
+	}
+
+	var resp CachedResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, false
+	}
+
+	return &resp, true
+}
+
+func (c *redisResponseCache) Set(ctx context.Context, key string, resp *CachedResponse, ttl time.Duration) {
+	resp.ExpiresAt = time.Now().Add(ttl)
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return
+	}
+
+	// keep the entry in Redis past its TTL for the stale-while-revalidate
+	// window, so withResponseCache can still serve it stale
+	staleTTL := time.Duration(conf.GetCacheConfiguration().StaleWhileRevalidateSeconds) * time.Second
+	c.client.Set(ctx, key, data, ttl+staleTTL)
+}
+
+func (c *redisResponseCache) Delete(ctx context.Context, pattern string) int {
+	keys, err := c.client.Keys(ctx, "*"+pattern+"*").Result()
+	if err != nil || len(keys) == 0 {
+		return 0
+	}
+
+	if err := c.client.Del(ctx, keys...).Err(); err != nil {
+		return 0
+	}
+
+	return len(keys)
+}
+
+var (
+	sharedCacheOnce sync.Once
+	sharedCache     ResponseCache
+)
+
+// getResponseCache lazily builds the ResponseCache backend selected by
+// conf.CacheConfiguration.Backend
+func getResponseCache() ResponseCache {
+	sharedCacheOnce.Do(func() {
+		cfg := conf.GetCacheConfiguration()
+
+		if cfg.Backend == "redis" {
+			sharedCache = newRedisResponseCache(cfg)
+			return
+		}
+
+		sharedCache = newLRUResponseCache(cfg.LRUSize)
+	})
+
+	return sharedCache
+}
+
+// endpointTTL resolves the configured TTL for an endpoint pattern
+func endpointTTL(pattern string) time.Duration {
+	cfg := conf.GetCacheConfiguration()
+
+	seconds, ok := cfg.EndpointTTLSeconds[pattern]
+	if !ok {
+		seconds = cfg.DefaultTTLSeconds
+	}
+	if seconds <= 0 {
+		seconds = 30
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// bufferingResponseWriter captures a handler's response so it can be stored
+// in the cache as well as written to the real client
+type bufferingResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	body       []byte
+}
+
+func (w *bufferingResponseWriter) WriteHeader(statusCode int) {
+	w.statusCode = statusCode
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *bufferingResponseWriter) Write(data []byte) (int, error) {
+	w.body = append(w.body, data...)
+	return w.ResponseWriter.Write(data)
+}
+
+// withResponseCache wraps next with a read-through cache keyed on method,
+// path, organization, cluster and auth principal. Fresh entries are served
+// straight from the cache; stale entries within the
+// stale-while-revalidate window are served immediately while next is
+// called in the background to refresh the entry.
+func (server *HTTPServer) withResponseCache(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodGet {
+			next(writer, request)
+			return
+		}
+
+		vars := mux.Vars(request)
+		key := cacheKey(pattern, request.Method, request.URL.Path, vars["organization"], vars["cluster"], request.Header.Get("Authorization"))
+
+		cache := getResponseCache()
+		ctx := request.Context()
+
+		if cached, ok := cache.Get(ctx, key); ok {
+			if match := request.Header.Get("If-None-Match"); match != "" && match == cached.ETag {
+				writer.WriteHeader(http.StatusNotModified)
+				cacheHitsCounter.WithLabelValues(pattern).Inc()
+				return
+			}
+
+			if cached.fresh() {
+				writeCachedResponse(writer, cached)
+				cacheHitsCounter.WithLabelValues(pattern).Inc()
+				return
+			}
+
+			staleTTL := time.Duration(conf.GetCacheConfiguration().StaleWhileRevalidateSeconds) * time.Second
+			if staleTTL > 0 && time.Since(cached.ExpiresAt) < staleTTL {
+				writeCachedResponse(writer, cached)
+				cacheHitsCounter.WithLabelValues(pattern).Inc()
+				go server.revalidate(pattern, key, next, request)
+				return
+			}
+		}
+
+		cacheMissesCounter.WithLabelValues(pattern).Inc()
+		server.serveAndCache(pattern, key, next, writer, request)
+	}
+}
+
+// serveAndCache calls next, then stores the resulting response in the
+// shared cache before returning
+func (server *HTTPServer) serveAndCache(pattern, key string, next http.HandlerFunc, writer http.ResponseWriter, request *http.Request) {
+	recorder := &bufferingResponseWriter{ResponseWriter: writer, statusCode: http.StatusOK}
+	next(recorder, request)
+
+	if recorder.statusCode != http.StatusOK {
+		return
+	}
+
+	etag := fmt.Sprintf("%x", sha256.Sum256(recorder.body))
+	writer.Header().Set("ETag", etag)
+
+	cached := &CachedResponse{
+		StatusCode: recorder.statusCode,
+		Header:     recorder.Header().Clone(),
+		Body:       recorder.body,
+		ETag:       etag,
+		StoredAt:   time.Now(),
+	}
+
+	getResponseCache().Set(request.Context(), key, cached, endpointTTL(pattern))
+}
+
+// revalidateTimeout bounds how long a background stale-while-revalidate
+// refresh may take
+const revalidateTimeout = 10 * time.Second
+
+// revalidate refreshes a stale cache entry in the background after it has
+// already been served to the client. It runs against its own context
+// derived from context.Background(), not request.Context(): the inbound
+// request's context is canceled as soon as the enclosing ServeHTTP call
+// returns, which happens right after this goroutine is spawned, so reusing
+// it would cancel the upstream call before the refresh can ever complete.
+func (server *HTTPServer) revalidate(pattern, key string, next http.HandlerFunc, request *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), revalidateTimeout)
+	defer cancel()
+
+	discard := &discardResponseWriter{header: make(http.Header)}
+	server.serveAndCache(pattern, key, next, discard, request.Clone(ctx))
+}
+
+// discardResponseWriter implements http.ResponseWriter without writing
+// anywhere, used to drive a background revalidation
+type discardResponseWriter struct {
+	header     http.Header
+	statusCode int
+}
+
+func (w *discardResponseWriter) Header() http.Header            { return w.header }
+func (w *discardResponseWriter) Write(data []byte) (int, error) { return len(data), nil }
+func (w *discardResponseWriter) WriteHeader(statusCode int)     { w.statusCode = statusCode }
+
+func writeCachedResponse(writer http.ResponseWriter, cached *CachedResponse) {
+	for name, values := range cached.Header {
+		for _, value := range values {
+			writer.Header().Add(name, value)
+		}
+	}
+	writer.Header().Set("ETag", cached.ETag)
+	writer.WriteHeader(cached.StatusCode)
+	_, _ = writer.Write(cached.Body)
+}
+
+// invalidateCacheEndpoint is a DEBUG-only admin endpoint that deletes every
+// cache entry whose key matches {pattern}
+func (server *HTTPServer) invalidateCacheEndpoint(writer http.ResponseWriter, request *http.Request) {
+	pattern := mux.Vars(request)["pattern"]
+
+	removed := getResponseCache().Delete(request.Context(), pattern)
+
+	writer.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(writer).Encode(map[string]int{"removed": removed})
+}
@@ -0,0 +1,91 @@
+// Copyright 2020 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLRUResponseCacheEvictsOldestEntry(t *testing.T) {
+	cache := newLRUResponseCache(2)
+	ctx := context.Background()
+
+	cache.Set(ctx, "a", &CachedResponse{}, time.Minute)
+	cache.Set(ctx, "b", &CachedResponse{}, time.Minute)
+	cache.Set(ctx, "c", &CachedResponse{}, time.Minute)
+
+	if _, ok := cache.Get(ctx, "a"); ok {
+		t.Fatalf("expected the oldest entry to have been evicted once capacity was exceeded")
+	}
+	if _, ok := cache.Get(ctx, "b"); !ok {
+		t.Fatalf("expected entry b to still be cached")
+	}
+	if _, ok := cache.Get(ctx, "c"); !ok {
+		t.Fatalf("expected entry c to still be cached")
+	}
+}
+
+func TestLRUResponseCacheGetRefreshesRecency(t *testing.T) {
+	cache := newLRUResponseCache(2)
+	ctx := context.Background()
+
+	cache.Set(ctx, "a", &CachedResponse{}, time.Minute)
+	cache.Set(ctx, "b", &CachedResponse{}, time.Minute)
+
+	// touching "a" should make "b" the next entry evicted
+	cache.Get(ctx, "a")
+	cache.Set(ctx, "c", &CachedResponse{}, time.Minute)
+
+	if _, ok := cache.Get(ctx, "b"); ok {
+		t.Fatalf("expected b to be evicted after a was the more recently used entry")
+	}
+	if _, ok := cache.Get(ctx, "a"); !ok {
+		t.Fatalf("expected a to survive eviction as the more recently used entry")
+	}
+}
+
+func TestCacheKeyEmbedsPatternForInvalidation(t *testing.T) {
+	key := cacheKey("report/{organization}/{cluster}", "GET", "/report/1/2", "1", "2", "token")
+
+	if !strings.HasPrefix(key, "report/{organization}/{cluster}") {
+		t.Fatalf("expected cache key %q to start with the endpoint pattern", key)
+	}
+}
+
+func TestLRUResponseCacheDeleteMatchesByPattern(t *testing.T) {
+	cache := newLRUResponseCache(10)
+	ctx := context.Background()
+
+	reportKey := cacheKey("report/{organization}/{cluster}", "GET", "/report/1/2", "1", "2", "token")
+	groupsKey := cacheKey("groups", "GET", "/groups", "", "", "token")
+
+	cache.Set(ctx, reportKey, &CachedResponse{}, time.Minute)
+	cache.Set(ctx, groupsKey, &CachedResponse{}, time.Minute)
+
+	removed := cache.Delete(ctx, "report/{organization}/{cluster}")
+	if removed != 1 {
+		t.Fatalf("expected exactly one entry to match the report pattern, removed %d", removed)
+	}
+
+	if _, ok := cache.Get(ctx, reportKey); ok {
+		t.Fatalf("expected the report entry to have been removed")
+	}
+	if _, ok := cache.Get(ctx, groupsKey); !ok {
+		t.Fatalf("expected the unrelated groups entry to survive the targeted invalidation")
+	}
+}
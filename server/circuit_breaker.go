@@ -0,0 +1,277 @@
+// Copyright 2020 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/RedHatInsights/insights-results-smart-proxy/conf"
+)
+
+// breakerState is the state of a circuit breaker for a single upstream
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+var (
+	breakerStateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "smart_proxy_breaker_state",
+		Help: "State of the per-upstream circuit breaker (0=closed, 1=open, 2=half-open)",
+	}, []string{"upstream"})
+
+	rateLimitedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "smart_proxy_rate_limited_total",
+		Help: "Total number of requests rejected by the per-upstream rate limiter",
+	}, []string{"upstream"})
+)
+
+// circuitBreaker is a simple failure-ratio breaker guarding a single
+// upstream. It counts requests and failures since it was created or last
+// closed and trips once at least MinRequestCount requests have been counted
+// and the failure ratio reaches FailureRatioThreshold. The counts are not
+// windowed: they keep accumulating until the breaker trips.
+type circuitBreaker struct {
+	mutex sync.Mutex
+
+	upstream string
+	cfg      conf.CircuitBreakerUpstreamConfiguration
+
+	state       breakerState
+	openedAt    time.Time
+	total       int
+	failures    int
+	halfOpenOKs int
+}
+
+func newCircuitBreaker(upstream string, cfg conf.CircuitBreakerUpstreamConfiguration) *circuitBreaker {
+	breakerStateGauge.WithLabelValues(upstream).Set(float64(breakerClosed))
+
+	return &circuitBreaker{
+		upstream: upstream,
+		cfg:      cfg,
+		state:    breakerClosed,
+	}
+}
+
+// allow reports whether a request may proceed, and if not, how many seconds
+// the caller should wait before retrying
+func (b *circuitBreaker) allow() (bool, int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state == breakerOpen {
+		cooldown := time.Duration(b.cfg.OpenStateCooldownSeconds) * time.Second
+		if time.Since(b.openedAt) < cooldown {
+			remaining := cooldown - time.Since(b.openedAt)
+			return false, int(remaining.Seconds()) + 1
+		}
+
+		b.state = breakerHalfOpen
+		b.halfOpenOKs = 0
+		breakerStateGauge.WithLabelValues(b.upstream).Set(float64(breakerHalfOpen))
+	}
+
+	return true, 0
+}
+
+// recordResult updates the breaker with the outcome of a proxied request
+func (b *circuitBreaker) recordResult(success bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case breakerHalfOpen:
+		if !success {
+			b.trip()
+			return
+		}
+
+		b.halfOpenOKs++
+		if b.halfOpenOKs >= b.cfg.HalfOpenProbeCount {
+			b.reset()
+		}
+	case breakerClosed:
+		// A breaker with no MinRequestCount configured (e.g. the
+		// circuit_breaker section is absent from config) must never trip -
+		// otherwise the zero-value threshold of 0 requests/0.0 failure
+		// ratio trips on the very first request, successful or not.
+		if b.cfg.MinRequestCount <= 0 {
+			return
+		}
+
+		b.total++
+		if !success {
+			b.failures++
+		}
+
+		if b.total >= b.cfg.MinRequestCount && float64(b.failures)/float64(b.total) >= b.cfg.FailureRatioThreshold {
+			b.trip()
+		}
+	}
+}
+
+func (b *circuitBreaker) trip() {
+	b.state = breakerOpen
+	b.openedAt = time.Now()
+	b.total = 0
+	b.failures = 0
+	breakerStateGauge.WithLabelValues(b.upstream).Set(float64(breakerOpen))
+}
+
+func (b *circuitBreaker) reset() {
+	b.state = breakerClosed
+	b.total = 0
+	b.failures = 0
+	breakerStateGauge.WithLabelValues(b.upstream).Set(float64(breakerClosed))
+}
+
+// tokenBucket is a minimal token-bucket rate limiter
+type tokenBucket struct {
+	mutex      sync.Mutex
+	tokens     float64
+	ratePerSec float64
+	burst      float64
+	lastRefill time.Time
+}
+
+func newTokenBucket(ratePerSec, burst int) *tokenBucket {
+	return &tokenBucket{
+		tokens:     float64(burst),
+		ratePerSec: float64(ratePerSec),
+		burst:      float64(burst),
+		lastRefill: time.Now(),
+	}
+}
+
+func (t *tokenBucket) take() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(t.lastRefill).Seconds()
+	t.lastRefill = now
+
+	t.tokens += elapsed * t.ratePerSec
+	if t.tokens > t.burst {
+		t.tokens = t.burst
+	}
+
+	if t.tokens < 1 {
+		return false
+	}
+
+	t.tokens--
+	return true
+}
+
+// upstreamGuard bundles the rate limiter and circuit breaker for a single
+// upstream
+type upstreamGuard struct {
+	cfg     conf.CircuitBreakerUpstreamConfiguration
+	limiter *tokenBucket
+	breaker *circuitBreaker
+}
+
+func newUpstreamGuard(upstream string, cfg conf.CircuitBreakerUpstreamConfiguration) *upstreamGuard {
+	return &upstreamGuard{
+		cfg:     cfg,
+		limiter: newTokenBucket(cfg.RateLimitRPS, cfg.RateLimitBurst),
+		breaker: newCircuitBreaker(upstream, cfg),
+	}
+}
+
+var (
+	upstreamGuardsMutex sync.Mutex
+	upstreamGuards      = map[string]*upstreamGuard{}
+)
+
+// getUpstreamGuard returns the shared rate limiter/circuit breaker pair for
+// upstream, creating it on first use. Every caller that talks to the same
+// upstream - whether through an HTTP route wrapped in withResilience or a
+// direct call such as the report/full gateway's fan-out - shares this guard,
+// so a tripped breaker or exhausted rate limit protects the upstream
+// regardless of which code path triggered it.
+func getUpstreamGuard(upstream string) *upstreamGuard {
+	upstreamGuardsMutex.Lock()
+	defer upstreamGuardsMutex.Unlock()
+
+	if guard, ok := upstreamGuards[upstream]; ok {
+		return guard
+	}
+
+	cfg := conf.GetCircuitBreakerConfiguration()
+
+	var upstreamCfg conf.CircuitBreakerUpstreamConfiguration
+	switch upstream {
+	case "content":
+		upstreamCfg = cfg.Content
+	default:
+		upstreamCfg = cfg.Aggregator
+	}
+
+	guard := newUpstreamGuard(upstream, upstreamCfg)
+	upstreamGuards[upstream] = guard
+	return guard
+}
+
+// statusRecordingWriter wraps http.ResponseWriter to capture the status
+// code written by the wrapped handler
+type statusRecordingWriter struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (w *statusRecordingWriter) WriteHeader(statusCode int) {
+	w.statusCode = statusCode
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+// withResilience wraps next with a per-upstream token-bucket rate limiter
+// and circuit breaker. Requests that exceed the rate limit or hit a tripped
+// breaker are short-circuited with a 503 and a Retry-After header instead
+// of being forwarded upstream.
+func (server *HTTPServer) withResilience(upstream string, next http.HandlerFunc) http.HandlerFunc {
+	guard := getUpstreamGuard(upstream)
+
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if guard.cfg.RateLimitRPS > 0 && !guard.limiter.take() {
+			rateLimitedCounter.WithLabelValues(upstream).Inc()
+			writer.Header().Set("Retry-After", "1")
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		if allowed, retryAfter := guard.breaker.allow(); !allowed {
+			writer.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		recorder := &statusRecordingWriter{ResponseWriter: writer, statusCode: http.StatusOK}
+		next(recorder, request)
+
+		guard.breaker.recordResult(recorder.statusCode < http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2020 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/RedHatInsights/insights-results-smart-proxy/conf"
+)
+
+func TestCircuitBreakerNeverTripsWithoutMinRequestCount(t *testing.T) {
+	breaker := newCircuitBreaker("test", conf.CircuitBreakerUpstreamConfiguration{})
+
+	for i := 0; i < 10; i++ {
+		breaker.recordResult(false)
+	}
+
+	if breaker.state != breakerClosed {
+		t.Fatalf("expected breaker to stay closed with MinRequestCount unconfigured, got state %d", breaker.state)
+	}
+}
+
+func TestCircuitBreakerTripsAtFailureRatioThreshold(t *testing.T) {
+	breaker := newCircuitBreaker("test", conf.CircuitBreakerUpstreamConfiguration{
+		MinRequestCount:          4,
+		FailureRatioThreshold:    0.5,
+		OpenStateCooldownSeconds: 30,
+	})
+
+	breaker.recordResult(true)
+	breaker.recordResult(false)
+	breaker.recordResult(false)
+	if breaker.state != breakerClosed {
+		t.Fatalf("expected breaker to still be closed before MinRequestCount is reached, got state %d", breaker.state)
+	}
+
+	breaker.recordResult(false)
+	if breaker.state != breakerOpen {
+		t.Fatalf("expected breaker to trip once failure ratio crosses threshold, got state %d", breaker.state)
+	}
+
+	if allowed, retryAfter := breaker.allow(); allowed || retryAfter <= 0 {
+		t.Fatalf("expected an open breaker to reject the request with a positive retry-after, got allowed=%v retryAfter=%d", allowed, retryAfter)
+	}
+}
+
+func TestCircuitBreakerHalfOpenRecovers(t *testing.T) {
+	breaker := newCircuitBreaker("test", conf.CircuitBreakerUpstreamConfiguration{
+		MinRequestCount:          1,
+		FailureRatioThreshold:    0,
+		OpenStateCooldownSeconds: 0,
+		HalfOpenProbeCount:       2,
+	})
+
+	breaker.recordResult(false)
+	if breaker.state != breakerOpen {
+		t.Fatalf("expected breaker to be open, got state %d", breaker.state)
+	}
+
+	if allowed, _ := breaker.allow(); !allowed {
+		t.Fatalf("expected a zero cooldown to let the probe through immediately")
+	}
+	if breaker.state != breakerHalfOpen {
+		t.Fatalf("expected breaker to move to half-open after cooldown elapses, got state %d", breaker.state)
+	}
+
+	breaker.recordResult(true)
+	if breaker.state != breakerHalfOpen {
+		t.Fatalf("expected breaker to stay half-open until HalfOpenProbeCount successes, got state %d", breaker.state)
+	}
+
+	breaker.recordResult(true)
+	if breaker.state != breakerClosed {
+		t.Fatalf("expected breaker to close after HalfOpenProbeCount consecutive successes, got state %d", breaker.state)
+	}
+}
+
+func TestCircuitBreakerHalfOpenReopensOnFailure(t *testing.T) {
+	breaker := newCircuitBreaker("test", conf.CircuitBreakerUpstreamConfiguration{
+		MinRequestCount:       1,
+		FailureRatioThreshold: 0,
+		HalfOpenProbeCount:    2,
+	})
+	breaker.state = breakerHalfOpen
+
+	breaker.recordResult(false)
+
+	if breaker.state != breakerOpen {
+		t.Fatalf("expected a failed half-open probe to re-open the breaker, got state %d", breaker.state)
+	}
+}
+
+func TestTokenBucketRejectsOnceBurstIsSpent(t *testing.T) {
+	bucket := newTokenBucket(0, 1)
+
+	if !bucket.take() {
+		t.Fatalf("expected the first request to consume the initial burst token")
+	}
+
+	if bucket.take() {
+		t.Fatalf("expected the second request to be rejected with no refill rate and an exhausted burst")
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2020 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/RedHatInsights/insights-results-smart-proxy/conf"
+)
+
+// findEgressRule looks up the named egress rule in conf.EgressConfiguration
+func findEgressRule(name string) (conf.EgressRule, bool) {
+	for _, rule := range conf.GetEgressConfiguration().Rules {
+		if rule.Name == name {
+			return rule, true
+		}
+	}
+
+	return conf.EgressRule{}, false
+}
+
+// pathAllowed reports whether path is reachable through rule, based on its
+// AllowedPaths prefixes. An empty AllowedPaths list allows every path.
+func pathAllowed(rule conf.EgressRule, path string) bool {
+	if len(rule.AllowedPaths) == 0 {
+		return true
+	}
+
+	for _, allowed := range rule.AllowedPaths {
+		if strings.HasPrefix(path, allowed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// destinationAllowed reports whether baseURL's host, port and protocol
+// match rule's Host/Port/Protocol. A rule with no Host configured skips
+// this check and relies on AllowedPaths alone. This catches the base
+// endpoint configured in services.* drifting away from the egress rule
+// that is supposed to describe it.
+func destinationAllowed(rule conf.EgressRule, baseURL string) bool {
+	if rule.Host == "" {
+		return true
+	}
+
+	parsed, err := url.Parse(baseURL)
+	if err != nil {
+		return false
+	}
+
+	if parsed.Hostname() != rule.Host {
+		return false
+	}
+
+	if rule.Protocol != "" && parsed.Scheme != rule.Protocol {
+		return false
+	}
+
+	if rule.Port != 0 {
+		port := parsed.Port()
+		if port == "" {
+			port = defaultPortForScheme(parsed.Scheme)
+		}
+		if port != strconv.Itoa(rule.Port) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// defaultPortForScheme returns the implicit port for a URL scheme whose
+// port was omitted
+func defaultPortForScheme(scheme string) string {
+	if scheme == "https" {
+		return "443"
+	}
+	return "80"
+}
+
+// isRetryableMethod reports whether method is listed in rule.RetryOnMethods
+func isRetryableMethod(rule conf.EgressRule, method string) bool {
+	for _, allowed := range rule.RetryOnMethods {
+		if strings.EqualFold(allowed, method) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// applyHeaderPolicy strips the headers configured on rule from request and
+// adds the ones configured to be appended
+func applyHeaderPolicy(rule conf.EgressRule, request *http.Request) {
+	for _, header := range rule.StripHeaders {
+		request.Header.Del(header)
+	}
+
+	for name, value := range rule.AddHeaders {
+		request.Header.Set(name, value)
+	}
+}
+
+// withEgressPolicy enforces the named egress rule around next: requests
+// whose path is not in the rule's allow-list are rejected, sensitive
+// inbound headers are stripped per rule, each attempt is bounded by
+// rule.TimeoutSeconds when set, and methods listed in rule.RetryOnMethods
+// are retried with exponential backoff up to rule.Retries times on a 5xx
+// response. Only that list decides: a non-idempotent method such as POST is
+// retried if it is listed.
+func (server *HTTPServer) withEgressPolicy(ruleName string, next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		rule, ok := findEgressRule(ruleName)
+		if !ok {
+			log.Error().Str("rule", ruleName).Msg("egress: no such rule configured, rejecting request")
+			http.Error(writer, "upstream not allowed", http.StatusForbidden)
+			return
+		}
+
+		if !pathAllowed(rule, request.URL.Path) {
+			log.Warn().Str("rule", ruleName).Str("path", request.URL.Path).Msg("egress: path not in allow-list")
+			http.Error(writer, "upstream path not allowed", http.StatusForbidden)
+			return
+		}
+
+		applyHeaderPolicy(rule, request)
+
+		attempts := 1
+		if isRetryableMethod(rule, request.Method) {
+			attempts += rule.Retries
+		}
+
+		// Buffer the body once up front: request.Body is a single-use
+		// io.ReadCloser, and once the first attempt's proxyTo call reads it
+		// a retried attempt would otherwise forward an empty body.
+		var bodyBytes []byte
+		if request.Body != nil {
+			bodyBytes, _ = io.ReadAll(request.Body)
+			_ = request.Body.Close()
+		}
+
+		backoff := 100 * time.Millisecond
+		var recorder *bufferedRecorder
+
+		for attempt := 0; attempt < attempts; attempt++ {
+			if attempt > 0 {
+				time.Sleep(backoff)
+				backoff *= 2
+			}
+
+			attemptRequest := request
+			if rule.TimeoutSeconds > 0 {
+				ctx, cancel := context.WithTimeout(request.Context(), time.Duration(rule.TimeoutSeconds)*time.Second)
+				defer cancel()
+				attemptRequest = request.Clone(ctx)
+			}
+			if bodyBytes != nil {
+				attemptRequest.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+			}
+
+			recorder = &bufferedRecorder{header: make(http.Header), statusCode: http.StatusOK}
+			next(recorder, attemptRequest)
+
+			if recorder.statusCode < http.StatusInternalServerError {
+				break
+			}
+		}
+
+		recorder.flush(writer)
+	}
+}
+
+// bufferedRecorder captures a handler's response in full so a failed
+// attempt can be discarded and retried without having already committed a
+// status code or partial body to the real client
+type bufferedRecorder struct {
+	header     http.Header
+	statusCode int
+	body       []byte
+}
+
+func (r *bufferedRecorder) Header() http.Header { return r.header }
+
+func (r *bufferedRecorder) Write(data []byte) (int, error) {
+	r.body = append(r.body, data...)
+	return len(data), nil
+}
+
+func (r *bufferedRecorder) WriteHeader(statusCode int) {
+	r.statusCode = statusCode
+}
+
+func (r *bufferedRecorder) flush(writer http.ResponseWriter) {
+	for name, values := range r.header {
+		for _, value := range values {
+			writer.Header().Add(name, value)
+		}
+	}
+	writer.WriteHeader(r.statusCode)
+	_, _ = writer.Write(r.body)
+}
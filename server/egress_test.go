@@ -0,0 +1,132 @@
+// Copyright 2020 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/RedHatInsights/insights-results-smart-proxy/conf"
+)
+
+func TestPathAllowed(t *testing.T) {
+	rule := conf.EgressRule{AllowedPaths: []string{"/api/v1/report"}}
+
+	if !pathAllowed(rule, "/api/v1/report/1/2") {
+		t.Fatalf("expected a path under an allowed prefix to be allowed")
+	}
+	if pathAllowed(rule, "/api/v1/organizations") {
+		t.Fatalf("expected a path outside every allowed prefix to be rejected")
+	}
+	if !pathAllowed(conf.EgressRule{}, "/anything") {
+		t.Fatalf("expected an empty allow-list to allow every path")
+	}
+}
+
+func TestDestinationAllowed(t *testing.T) {
+	rule := conf.EgressRule{Host: "aggregator.example.com", Port: 8080, Protocol: "https"}
+
+	if !destinationAllowed(rule, "https://aggregator.example.com:8080/api/v1/") {
+		t.Fatalf("expected a base URL matching host/port/protocol to be allowed")
+	}
+	if destinationAllowed(rule, "https://evil.example.com:8080/api/v1/") {
+		t.Fatalf("expected a mismatched host to be rejected")
+	}
+	if destinationAllowed(rule, "https://aggregator.example.com:9090/api/v1/") {
+		t.Fatalf("expected a mismatched port to be rejected")
+	}
+	if destinationAllowed(rule, "http://aggregator.example.com:8080/api/v1/") {
+		t.Fatalf("expected a mismatched protocol to be rejected")
+	}
+	if !destinationAllowed(conf.EgressRule{}, "https://anything.example.com/") {
+		t.Fatalf("expected a rule with no Host configured to skip destination validation")
+	}
+}
+
+func TestIsRetryableMethod(t *testing.T) {
+	rule := conf.EgressRule{RetryOnMethods: []string{"get", "PUT"}}
+
+	if !isRetryableMethod(rule, http.MethodGet) {
+		t.Fatalf("expected GET to be retryable regardless of the configured case")
+	}
+	if !isRetryableMethod(rule, http.MethodPut) {
+		t.Fatalf("expected PUT to be retryable")
+	}
+	if isRetryableMethod(rule, http.MethodPost) {
+		t.Fatalf("expected POST to not be retryable when absent from RetryOnMethods")
+	}
+}
+
+func TestWithEgressPolicyRetriesAndRewindsBody(t *testing.T) {
+	conf.Config.Egress = conf.EgressConfiguration{Rules: []conf.EgressRule{{
+		Name:           "test",
+		Retries:        2,
+		RetryOnMethods: []string{http.MethodPost},
+	}}}
+
+	var bodiesSeen []string
+	attempts := 0
+
+	server := &HTTPServer{}
+	handler := server.withEgressPolicy("test", func(writer http.ResponseWriter, request *http.Request) {
+		attempts++
+		body, _ := io.ReadAll(request.Body)
+		bodiesSeen = append(bodiesSeen, string(body))
+
+		if attempts < 3 {
+			writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writer.WriteHeader(http.StatusOK)
+	})
+
+	request := httptest.NewRequest(http.MethodPost, "/report/1/2", strings.NewReader("payload"))
+	recorder := httptest.NewRecorder()
+
+	handler(recorder, request)
+
+	if attempts != 3 {
+		t.Fatalf("expected 1 initial attempt + 2 retries = 3 calls, got %d", attempts)
+	}
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected the final successful attempt's status to be returned, got %d", recorder.Code)
+	}
+	for i, body := range bodiesSeen {
+		if body != "payload" {
+			t.Fatalf("expected attempt %d to see the full original body, got %q", i, body)
+		}
+	}
+}
+
+func TestWithEgressPolicyRejectsUnknownRule(t *testing.T) {
+	conf.Config.Egress = conf.EgressConfiguration{}
+
+	server := &HTTPServer{}
+	handler := server.withEgressPolicy("missing", func(http.ResponseWriter, *http.Request) {
+		t.Fatalf("next should not be called when the egress rule is not configured")
+	})
+
+	request := httptest.NewRequest(http.MethodGet, "/report/1/2", nil)
+	recorder := httptest.NewRecorder()
+
+	handler(recorder, request)
+
+	if recorder.Code != http.StatusForbidden {
+		t.Fatalf("expected a missing egress rule to be rejected with 403, got %d", recorder.Code)
+	}
+}
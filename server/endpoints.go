@@ -35,6 +35,9 @@ const (
 	OrganizationsEndpoint = "organizations"
 	// ReportEndpoint returns report for provided {organization} and {cluster}
 	ReportEndpoint = "report/{organization}/{cluster}"
+	// FullReportEndpoint returns report for provided {organization} and
+	// {cluster}, enriched with rule content from the content service
+	FullReportEndpoint = "report/{organization}/{cluster}/full"
 	// LikeRuleEndpoint likes rule with {rule_id} for {cluster} using current user(from auth header)
 	LikeRuleEndpoint = "clusters/{cluster}/rules/{rule_id}/like"
 	// DislikeRuleEndpoint dislikes rule with {rule_id} for {cluster} using current user(from auth header)
@@ -58,20 +61,28 @@ const (
 	EnableRuleForClusterEndpoint = "clusters/{cluster}/rules/{rule_id}/enable"
 	// MetricsEndpoint returns prometheus metrics
 	MetricsEndpoint = "metrics"
+	// CacheInvalidationEndpoint deletes cache entries matching {pattern}. DEBUG only
+	CacheInvalidationEndpoint = "cache/{pattern}"
+	// LivezEndpoint returns 200 if the process is able to handle requests
+	LivezEndpoint = "livez"
+	// ReadyzEndpoint returns 200 if the process and its dependencies
+	// (aggregator, content service, cache backend) are reachable
+	ReadyzEndpoint = "readyz"
 )
 
 func (server *HTTPServer) addDebugEndpointsToRouter(router *mux.Router) {
 	apiPrefix := server.Config.APIPrefix
 	aggregatorEndpoint := server.ServicesConfig.AggregatorBaseEndpoint
 
-	router.HandleFunc(apiPrefix+OrganizationsEndpoint, server.proxyTo(aggregatorEndpoint)).Methods(http.MethodGet)
-	router.HandleFunc(apiPrefix+DeleteOrganizationsEndpoint, server.proxyTo(aggregatorEndpoint)).Methods(http.MethodDelete)
-	router.HandleFunc(apiPrefix+DeleteClustersEndpoint, server.proxyTo(aggregatorEndpoint)).Methods(http.MethodDelete)
-	router.HandleFunc(apiPrefix+GetVoteOnRuleEndpoint, server.proxyTo(aggregatorEndpoint)).Methods(http.MethodGet)
-	router.HandleFunc(apiPrefix+RuleEndpoint, server.proxyTo(aggregatorEndpoint)).Methods(http.MethodPost)
-	router.HandleFunc(apiPrefix+RuleErrorKeyEndpoint, server.proxyTo(aggregatorEndpoint)).Methods(http.MethodPost)
-	router.HandleFunc(apiPrefix+RuleEndpoint, server.proxyTo(aggregatorEndpoint)).Methods(http.MethodDelete)
-	router.HandleFunc(apiPrefix+RuleErrorKeyEndpoint, server.proxyTo(aggregatorEndpoint)).Methods(http.MethodDelete)
+	router.HandleFunc(apiPrefix+OrganizationsEndpoint, server.withEgressPolicy("aggregator", server.proxyTo(aggregatorEndpoint))).Methods(http.MethodGet)
+	router.HandleFunc(apiPrefix+DeleteOrganizationsEndpoint, server.withEgressPolicy("aggregator", server.proxyTo(aggregatorEndpoint))).Methods(http.MethodDelete)
+	router.HandleFunc(apiPrefix+DeleteClustersEndpoint, server.withEgressPolicy("aggregator", server.proxyTo(aggregatorEndpoint))).Methods(http.MethodDelete)
+	router.HandleFunc(apiPrefix+GetVoteOnRuleEndpoint, server.withEgressPolicy("aggregator", server.proxyTo(aggregatorEndpoint))).Methods(http.MethodGet)
+	router.HandleFunc(apiPrefix+RuleEndpoint, server.withEgressPolicy("aggregator", server.proxyTo(aggregatorEndpoint))).Methods(http.MethodPost)
+	router.HandleFunc(apiPrefix+RuleErrorKeyEndpoint, server.withEgressPolicy("aggregator", server.proxyTo(aggregatorEndpoint))).Methods(http.MethodPost)
+	router.HandleFunc(apiPrefix+RuleEndpoint, server.withEgressPolicy("aggregator", server.proxyTo(aggregatorEndpoint))).Methods(http.MethodDelete)
+	router.HandleFunc(apiPrefix+RuleErrorKeyEndpoint, server.withEgressPolicy("aggregator", server.proxyTo(aggregatorEndpoint))).Methods(http.MethodDelete)
+	router.HandleFunc(apiPrefix+CacheInvalidationEndpoint, server.invalidateCacheEndpoint).Methods(http.MethodDelete)
 
 	// endpoints for pprof - needed for profiling, ie. usually in debug mode
 	router.PathPrefix("/debug/pprof/").Handler(http.DefaultServeMux)
@@ -83,6 +94,9 @@ func (server *HTTPServer) addEndpointsToRouter(router *mux.Router) {
 	aggregatorEndpoint := server.ServicesConfig.AggregatorBaseEndpoint
 	contentServiceEndpoint := server.ServicesConfig.ContentBaseEndpoint
 
+	initTracing()
+	router.Use(tracingMiddleware)
+
 	// it is possible to use special REST API endpoints in debug mode
 	if server.Config.Debug {
 		server.addDebugEndpointsToRouter(router)
@@ -90,15 +104,18 @@ func (server *HTTPServer) addEndpointsToRouter(router *mux.Router) {
 
 	// common REST API endpoints
 	router.HandleFunc(apiPrefix+MainEndpoint, server.mainEndpoint).Methods(http.MethodGet)
-	router.HandleFunc(apiPrefix+ReportEndpoint, server.proxyTo(aggregatorEndpoint)).Methods(http.MethodGet, http.MethodOptions)
-	router.HandleFunc(apiPrefix+LikeRuleEndpoint, server.proxyTo(aggregatorEndpoint)).Methods(http.MethodPut, http.MethodOptions)
-	router.HandleFunc(apiPrefix+DislikeRuleEndpoint, server.proxyTo(aggregatorEndpoint)).Methods(http.MethodPut, http.MethodOptions)
-	router.HandleFunc(apiPrefix+ResetVoteOnRuleEndpoint, server.proxyTo(aggregatorEndpoint)).Methods(http.MethodPut, http.MethodOptions)
-	router.HandleFunc(apiPrefix+ClustersForOrganizationEndpoint, server.proxyTo(aggregatorEndpoint)).Methods(http.MethodGet)
-	router.HandleFunc(apiPrefix+DisableRuleForClusterEndpoint, server.proxyTo(aggregatorEndpoint)).Methods(http.MethodPut, http.MethodOptions)
-	router.HandleFunc(apiPrefix+EnableRuleForClusterEndpoint, server.proxyTo(aggregatorEndpoint)).Methods(http.MethodPut, http.MethodOptions)
-	router.HandleFunc(apiPrefix+RuleGroupsEndpoint, server.proxyTo(contentServiceEndpoint)).Methods(http.MethodGet, http.MethodOptions)
-	router.HandleFunc(apiPrefix+RuleErrorKeyEndpoint, server.proxyTo(aggregatorEndpoint)).Methods(http.MethodGet)
+	router.HandleFunc(apiPrefix+LivezEndpoint, server.livezEndpoint).Methods(http.MethodGet)
+	router.HandleFunc(apiPrefix+ReadyzEndpoint, server.readyzEndpoint).Methods(http.MethodGet)
+	router.HandleFunc(apiPrefix+ReportEndpoint, server.withResponseCache(ReportEndpoint, server.withResilience("aggregator", server.withEgressPolicy("aggregator", server.proxyTo(aggregatorEndpoint))))).Methods(http.MethodGet, http.MethodOptions)
+	router.HandleFunc(apiPrefix+FullReportEndpoint, server.fullReportEndpoint).Methods(http.MethodGet, http.MethodOptions)
+	router.HandleFunc(apiPrefix+LikeRuleEndpoint, server.withResilience("aggregator", server.withEgressPolicy("aggregator", server.proxyTo(aggregatorEndpoint)))).Methods(http.MethodPut, http.MethodOptions)
+	router.HandleFunc(apiPrefix+DislikeRuleEndpoint, server.withResilience("aggregator", server.withEgressPolicy("aggregator", server.proxyTo(aggregatorEndpoint)))).Methods(http.MethodPut, http.MethodOptions)
+	router.HandleFunc(apiPrefix+ResetVoteOnRuleEndpoint, server.withResilience("aggregator", server.withEgressPolicy("aggregator", server.proxyTo(aggregatorEndpoint)))).Methods(http.MethodPut, http.MethodOptions)
+	router.HandleFunc(apiPrefix+ClustersForOrganizationEndpoint, server.withResilience("aggregator", server.withEgressPolicy("aggregator", server.proxyTo(aggregatorEndpoint)))).Methods(http.MethodGet)
+	router.HandleFunc(apiPrefix+DisableRuleForClusterEndpoint, server.withResilience("aggregator", server.withEgressPolicy("aggregator", server.proxyTo(aggregatorEndpoint)))).Methods(http.MethodPut, http.MethodOptions)
+	router.HandleFunc(apiPrefix+EnableRuleForClusterEndpoint, server.withResilience("aggregator", server.withEgressPolicy("aggregator", server.proxyTo(aggregatorEndpoint)))).Methods(http.MethodPut, http.MethodOptions)
+	router.HandleFunc(apiPrefix+RuleGroupsEndpoint, server.withResponseCache(RuleGroupsEndpoint, server.withResilience("content", server.withEgressPolicy("content", server.proxyTo(contentServiceEndpoint))))).Methods(http.MethodGet, http.MethodOptions)
+	router.HandleFunc(apiPrefix+RuleErrorKeyEndpoint, server.withResponseCache(RuleErrorKeyEndpoint, server.withResilience("aggregator", server.withEgressPolicy("aggregator", server.proxyTo(aggregatorEndpoint))))).Methods(http.MethodGet)
 
 	// Prometheus metrics
 	router.Handle(apiPrefix+MetricsEndpoint, promhttp.Handler()).Methods(http.MethodGet)
@@ -0,0 +1,281 @@
+// Copyright 2020 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+)
+
+// fullReportDeadline bounds how long the fan-out to the aggregator and the
+// content service is allowed to take. An aggregator call still pending at
+// the deadline fails the request; a content call still pending leaves the
+// report returned with content_status "partial".
+const fullReportDeadline = 5 * time.Second
+
+// ruleContent is the subset of the content-service rule representation
+// needed to enrich a report entry
+type ruleContent struct {
+	Description string            `json:"description"`
+	Reason      string            `json:"reason"`
+	Resolution  string            `json:"resolution"`
+	Tags        []string          `json:"tags"`
+	Generic     string            `json:"generic"`
+	Extra       map[string]string `json:"-"`
+}
+
+// reportRule is a single rule hit inside the aggregator report, enriched
+// with its content-service description once both fan-out calls complete
+type reportRule struct {
+	RuleID      string       `json:"rule_id"`
+	ErrorKey    string       `json:"error_key"`
+	Description string       `json:"description,omitempty"`
+	Reason      string       `json:"reason,omitempty"`
+	Resolution  string       `json:"resolution,omitempty"`
+	Tags        []string     `json:"tags,omitempty"`
+	Content     *ruleContent `json:"-"`
+}
+
+// aggregatorReport is the shape of the report the aggregator returns for
+// an organization/cluster pair
+type aggregatorReport struct {
+	Meta json.RawMessage `json:"meta"`
+	Data []reportRule    `json:"data"`
+}
+
+// fullReportResponse is the composite payload returned by the
+// report/{organization}/{cluster}/full gateway endpoint
+type fullReportResponse struct {
+	Meta          json.RawMessage `json:"meta"`
+	Data          []reportRule    `json:"data"`
+	ContentStatus string          `json:"content_status"`
+}
+
+// fullReportEndpoint fans out concurrently to the aggregator (report data)
+// and the content service (rule descriptions, remediations, tags) and
+// joins the two by rule_id/error_key into a single enriched payload. A
+// failure to reach the content service degrades gracefully: the report is
+// still returned, with content_status set to "partial" instead of the
+// request failing outright.
+func (server *HTTPServer) fullReportEndpoint(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	organization := vars["organization"]
+	cluster := vars["cluster"]
+
+	ctx, cancel := context.WithTimeout(request.Context(), fullReportDeadline)
+	defer cancel()
+
+	type reportResult struct {
+		report *aggregatorReport
+		err    error
+	}
+	type contentResult struct {
+		content map[string]ruleContent
+		err     error
+	}
+
+	reportCh := make(chan reportResult, 1)
+	contentCh := make(chan contentResult, 1)
+
+	authorization := request.Header.Get("Authorization")
+
+	go func() {
+		report, err := server.fetchAggregatorReport(ctx, organization, cluster, authorization)
+		reportCh <- reportResult{report: report, err: err}
+	}()
+
+	go func() {
+		content, err := server.fetchRuleContent(ctx, authorization)
+		contentCh <- contentResult{content: content, err: err}
+	}()
+
+	reportRes := <-reportCh
+	if reportRes.err != nil {
+		log.Error().Err(reportRes.err).Msg("full report: aggregator call failed")
+		http.Error(writer, "unable to retrieve report", http.StatusBadGateway)
+		return
+	}
+
+	contentStatus := "ok"
+	contentRes := <-contentCh
+	if contentRes.err != nil {
+		log.Error().Err(contentRes.err).Msg("full report: content service call failed, degrading to partial")
+		contentStatus = "partial"
+	}
+
+	for i := range reportRes.report.Data {
+		rule := &reportRes.report.Data[i]
+		if content, ok := contentRes.content[rule.RuleID+"|"+rule.ErrorKey]; ok {
+			rule.Description = content.Description
+			rule.Reason = content.Reason
+			rule.Resolution = content.Resolution
+			rule.Tags = content.Tags
+		}
+	}
+
+	response := fullReportResponse{
+		Meta:          reportRes.report.Meta,
+		Data:          reportRes.report.Data,
+		ContentStatus: contentStatus,
+	}
+
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(writer).Encode(response); err != nil {
+		log.Error().Err(err).Msg("full report: unable to encode response")
+	}
+}
+
+// fetchAggregatorReport retrieves the raw report for organization/cluster
+// from the aggregator service, forwarding the caller's Authorization header
+func (server *HTTPServer) fetchAggregatorReport(ctx context.Context, organization, cluster, authorization string) (*aggregatorReport, error) {
+	url := fmt.Sprintf("%sreport/%s/%s", server.ServicesConfig.AggregatorBaseEndpoint, organization, cluster)
+
+	body, err := guardedGetJSON(ctx, "aggregator", url, authorization)
+	if err != nil {
+		return nil, err
+	}
+
+	var report aggregatorReport
+	if err := json.Unmarshal(body, &report); err != nil {
+		return nil, err
+	}
+
+	return &report, nil
+}
+
+// fetchRuleContent retrieves all rule content from the content service,
+// forwarding the caller's Authorization header, and decodes it as a JSON
+// object keyed by "rule_id|error_key". The keys are taken from the response
+// as they are; no re-indexing is done here.
+func (server *HTTPServer) fetchRuleContent(ctx context.Context, authorization string) (map[string]ruleContent, error) {
+	url := server.ServicesConfig.ContentBaseEndpoint + "content"
+
+	body, err := guardedGetJSON(ctx, "content", url, authorization)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]ruleContent
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, err
+	}
+
+	return raw, nil
+}
+
+// guardedGetJSON applies the same egress allow-list and per-upstream
+// resilience (rate limiting, circuit breaking) policy that HTTP routes get
+// from withEgressPolicy/withResilience, then delegates to getJSON. The
+// report/full gateway's fan-out calls use this instead of calling getJSON
+// directly so they cannot bypass the protections the rest of the routes
+// rely on.
+func guardedGetJSON(ctx context.Context, upstream, requestURL, authorization string) ([]byte, error) {
+	rule, ok := findEgressRule(upstream)
+	if !ok {
+		return nil, fmt.Errorf("egress: no rule configured for upstream %s", upstream)
+	}
+
+	parsed, err := neturl.Parse(requestURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if !pathAllowed(rule, parsed.Path) {
+		return nil, fmt.Errorf("egress: path %s not allowed for upstream %s", parsed.Path, upstream)
+	}
+
+	if !destinationAllowed(rule, requestURL) {
+		return nil, fmt.Errorf("egress: destination %s does not match the %s rule's host/port/protocol", requestURL, upstream)
+	}
+
+	guard := getUpstreamGuard(upstream)
+
+	if guard.cfg.RateLimitRPS > 0 && !guard.limiter.take() {
+		rateLimitedCounter.WithLabelValues(upstream).Inc()
+		return nil, fmt.Errorf("upstream %s is rate limited", upstream)
+	}
+
+	if allowed, retryAfter := guard.breaker.allow(); !allowed {
+		return nil, fmt.Errorf("upstream %s circuit breaker open, retry after %ds", upstream, retryAfter)
+	}
+
+	body, err := getJSON(ctx, upstream, requestURL, authorization)
+
+	// Only 5xx responses and transport-level failures (timeouts, connection
+	// errors) count as a breaker failure, matching withResilience's own
+	// threshold (circuit_breaker.go) - an ordinary 4xx (unknown cluster,
+	// missing auth) must not trip the shared breaker for every other route
+	// using this upstream.
+	failed := false
+	if err != nil {
+		var statusErr *upstreamStatusError
+		if errors.As(err, &statusErr) {
+			failed = statusErr.statusCode >= http.StatusInternalServerError
+		} else {
+			failed = true
+		}
+	}
+	guard.breaker.recordResult(!failed)
+
+	return body, err
+}
+
+// upstreamStatusError reports a non-2xx response from getJSON, preserving
+// the status code so callers can distinguish a client error (4xx) from a
+// server error (5xx) instead of treating every non-2xx response the same
+type upstreamStatusError struct {
+	upstream   string
+	statusCode int
+}
+
+func (e *upstreamStatusError) Error() string {
+	return fmt.Sprintf("upstream %s returned status %d", e.upstream, e.statusCode)
+}
+
+// getJSON performs a context-bound, traced GET request against upstream and
+// returns the raw response body, failing on any non-2xx status code. The
+// authorization header, when non-empty, is forwarded from the inbound
+// request so the upstream call carries the original caller's credentials.
+func getJSON(ctx context.Context, upstream, url, authorization string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	resp, err := tracedHTTPClient(upstream).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return nil, &upstreamStatusError{upstream: upstream, statusCode: resp.StatusCode}
+	}
+
+	return io.ReadAll(resp.Body)
+}
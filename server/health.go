@@ -0,0 +1,166 @@
+// Copyright 2020 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/RedHatInsights/insights-results-smart-proxy/conf"
+)
+
+// readyzProbeCacheTTL bounds how often readyz actually re-probes the
+// dependencies instead of serving the last known result
+const readyzProbeCacheTTL = 5 * time.Second
+
+// dependencyUpGauge exposes the up/down status of every probed dependency
+// individually, so alerting can key off one dependency instead of the
+// aggregate readyz response
+var dependencyUpGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "smart_proxy_dependency_up",
+	Help: "Whether a smart-proxy dependency is reachable (1) or not (0)",
+}, []string{"name"})
+
+// dependencyCheck is the result of probing a single dependency
+type dependencyCheck struct {
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	LatencyMs int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+// readyzResponse is the JSON body returned by the readyz endpoint
+type readyzResponse struct {
+	Checks []dependencyCheck `json:"checks"`
+}
+
+var (
+	readyzCacheMutex sync.Mutex
+	readyzCachedAt   time.Time
+	readyzCached     readyzResponse
+)
+
+// mainEndpoint, livezEndpoint and readyzEndpoint are intentionally small:
+// livez only asserts the process itself can still handle a request, while
+// readyz additionally asserts its dependencies are reachable.
+
+// livezEndpoint reports whether the process event loop is still able to
+// handle requests. It never touches a downstream dependency, so it always
+// returns quickly even if the aggregator or content service are down.
+func (server *HTTPServer) livezEndpoint(writer http.ResponseWriter, _ *http.Request) {
+	writer.WriteHeader(http.StatusOK)
+}
+
+// readyzEndpoint probes every configured dependency (aggregator, content
+// service, and the cache backend when Redis-backed) and reports 503 if any
+// of them is unreachable. Probe results are cached for readyzProbeCacheTTL
+// so readyz can be polled frequently by Kubernetes without hammering the
+// dependencies.
+func (server *HTTPServer) readyzEndpoint(writer http.ResponseWriter, request *http.Request) {
+	response := server.cachedDependencyChecks(request.Context())
+
+	ready := true
+	for _, check := range response.Checks {
+		if check.Status != "up" {
+			ready = false
+		}
+	}
+
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if !ready {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	_ = json.NewEncoder(writer).Encode(response)
+}
+
+// cachedDependencyChecks returns the last dependency probe result if it is
+// still fresh, otherwise it re-probes every dependency
+func (server *HTTPServer) cachedDependencyChecks(ctx context.Context) readyzResponse {
+	readyzCacheMutex.Lock()
+	defer readyzCacheMutex.Unlock()
+
+	if time.Since(readyzCachedAt) < readyzProbeCacheTTL {
+		return readyzCached
+	}
+
+	checks := []dependencyCheck{
+		probeHTTP(ctx, "aggregator", server.ServicesConfig.AggregatorBaseEndpoint),
+		probeHTTP(ctx, "content", server.ServicesConfig.ContentBaseEndpoint),
+	}
+
+	if cacheCfg := conf.GetCacheConfiguration(); cacheCfg.Backend == "redis" {
+		checks = append(checks, probeCacheBackend(ctx))
+	}
+
+	for _, check := range checks {
+		status := 0.0
+		if check.Status == "up" {
+			status = 1.0
+		}
+		dependencyUpGauge.WithLabelValues(check.Name).Set(status)
+	}
+
+	readyzCached = readyzResponse{Checks: checks}
+	readyzCachedAt = time.Now()
+
+	return readyzCached
+}
+
+// probeHTTP issues a HEAD request against baseURL and reports its outcome
+func probeHTTP(ctx context.Context, name, baseURL string) dependencyCheck {
+	start := time.Now()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, baseURL, nil)
+	if err != nil {
+		return dependencyCheck{Name: name, Status: "down", Error: err.Error()}
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	latency := time.Since(start).Milliseconds()
+	if err != nil {
+		return dependencyCheck{Name: name, Status: "down", LatencyMs: latency, Error: err.Error()}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return dependencyCheck{Name: name, Status: "down", LatencyMs: latency, Error: resp.Status}
+	}
+
+	return dependencyCheck{Name: name, Status: "up", LatencyMs: latency}
+}
+
+// probeCacheBackend checks that the configured Redis cache backend is
+// reachable
+func probeCacheBackend(ctx context.Context) dependencyCheck {
+	start := time.Now()
+
+	cache, ok := getResponseCache().(*redisResponseCache)
+	if !ok {
+		return dependencyCheck{Name: "cache", Status: "up", LatencyMs: 0}
+	}
+
+	if err := cache.client.Ping(ctx).Err(); err != nil {
+		return dependencyCheck{Name: "cache", Status: "down", LatencyMs: time.Since(start).Milliseconds(), Error: err.Error()}
+	}
+
+	return dependencyCheck{Name: "cache", Status: "up", LatencyMs: time.Since(start).Milliseconds()}
+}
@@ -0,0 +1,59 @@
+// Copyright 2020 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCachedDependencyChecksServesFreshResultWithoutReprobing(t *testing.T) {
+	readyzCacheMutex.Lock()
+	readyzCachedAt = time.Now()
+	readyzCached = readyzResponse{Checks: []dependencyCheck{{Name: "aggregator", Status: "up"}}}
+	readyzCacheMutex.Unlock()
+
+	// An unreachable base endpoint would make a real probe fail slowly;
+	// since the cached result is still fresh, cachedDependencyChecks must
+	// return it without calling out to this address at all.
+	server := &HTTPServer{}
+	server.ServicesConfig.AggregatorBaseEndpoint = "http://127.0.0.1:1/unreachable"
+
+	response := server.cachedDependencyChecks(context.Background())
+
+	if len(response.Checks) != 1 || response.Checks[0].Name != "aggregator" || response.Checks[0].Status != "up" {
+		t.Fatalf("expected the cached dependency check to be served as-is, got %+v", response.Checks)
+	}
+}
+
+func TestCachedDependencyChecksReprobesAfterTTLExpires(t *testing.T) {
+	readyzCacheMutex.Lock()
+	readyzCachedAt = time.Now().Add(-2 * readyzProbeCacheTTL)
+	readyzCached = readyzResponse{Checks: []dependencyCheck{{Name: "aggregator", Status: "up"}}}
+	readyzCacheMutex.Unlock()
+
+	server := &HTTPServer{}
+	server.ServicesConfig.AggregatorBaseEndpoint = "http://127.0.0.1:0"
+	server.ServicesConfig.ContentBaseEndpoint = "http://127.0.0.1:0"
+
+	response := server.cachedDependencyChecks(context.Background())
+
+	for _, check := range response.Checks {
+		if check.Name == "aggregator" && check.Status == "up" {
+			t.Fatalf("expected a stale cache entry to be replaced by a fresh probe against an unreachable endpoint")
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// proxyUpstream names the upstream baseURL points at, for metrics and
+// tracing span attributes
+func (server *HTTPServer) proxyUpstream(baseURL string) string {
+	if baseURL == server.ServicesConfig.ContentBaseEndpoint {
+		return "content"
+	}
+	return "aggregator"
+}
+
+// proxyTo returns a handler that forwards the inbound request to baseURL,
+// preserving method, headers, body and query string, and relays the
+// upstream's status code, headers and body back to the client unchanged.
+// The outbound call is made with tracedHTTPClient so it carries the W3C
+// traceparent/baggage headers and gets its own span in the request's trace.
+func (server *HTTPServer) proxyTo(baseURL string) http.HandlerFunc {
+	upstream := server.proxyUpstream(baseURL)
+
+	if rule, ok := findEgressRule(upstream); ok && !destinationAllowed(rule, baseURL) {
+		log.Error().Str("upstream", upstream).Str("base_url", baseURL).
+			Str("rule_host", rule.Host).Int("rule_port", rule.Port).Str("rule_protocol", rule.Protocol).
+			Msg("proxyTo: configured base endpoint does not match its egress rule's host/port/protocol, refusing to proxy")
+
+		return func(writer http.ResponseWriter, _ *http.Request) {
+			http.Error(writer, "upstream not allowed", http.StatusForbidden)
+		}
+	}
+
+	return func(writer http.ResponseWriter, request *http.Request) {
+		relativePath := strings.TrimPrefix(request.URL.Path, server.Config.APIPrefix)
+		targetURL := strings.TrimSuffix(baseURL, "/") + "/" + strings.TrimPrefix(relativePath, "/")
+		if request.URL.RawQuery != "" {
+			targetURL += "?" + request.URL.RawQuery
+		}
+
+		outboundRequest, err := http.NewRequestWithContext(request.Context(), request.Method, targetURL, request.Body)
+		if err != nil {
+			log.Error().Err(err).Str("upstream", upstream).Msg("proxyTo: unable to build outbound request")
+			http.Error(writer, "unable to reach upstream", http.StatusBadGateway)
+			return
+		}
+		outboundRequest.Header = request.Header.Clone()
+
+		resp, err := tracedHTTPClient(upstream).Do(outboundRequest)
+		if err != nil {
+			log.Error().Err(err).Str("upstream", upstream).Msg("proxyTo: upstream request failed")
+			http.Error(writer, "upstream unavailable", http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+
+		for name, values := range resp.Header {
+			for _, value := range values {
+				writer.Header().Add(name, value)
+			}
+		}
+		writer.WriteHeader(resp.StatusCode)
+
+		if _, err := io.Copy(writer, resp.Body); err != nil {
+			log.Error().Err(err).Str("upstream", upstream).Msg("proxyTo: unable to stream upstream response")
+		}
+	}
+}
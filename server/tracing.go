@@ -0,0 +1,151 @@
+// Copyright 2020 Red Hat, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/RedHatInsights/insights-results-smart-proxy/conf"
+)
+
+var tracingInitOnce sync.Once
+
+// initTracing builds the global OTLP tracer provider from
+// conf.TracingConfiguration. It is a no-op if tracing is disabled, and only
+// ever runs once regardless of how many times addEndpointsToRouter is called.
+func initTracing() {
+	tracingInitOnce.Do(func() {
+		cfg := conf.GetTracingConfiguration()
+		if !cfg.Enabled {
+			return
+		}
+
+		exporter, err := otlptracehttp.New(
+			context.Background(),
+			otlptracehttp.WithEndpoint(cfg.Endpoint),
+			otlptracehttp.WithInsecure(),
+		)
+		if err != nil {
+			log.Error().Err(err).Msg("tracing: unable to create OTLP exporter, tracing disabled")
+			return
+		}
+
+		res, err := resource.New(context.Background(), resource.WithAttributes(
+			semconv.ServiceNameKey.String(cfg.ServiceName),
+		))
+		if err != nil {
+			log.Error().Err(err).Msg("tracing: unable to build resource, tracing disabled")
+			return
+		}
+
+		provider := sdktrace.NewTracerProvider(
+			sdktrace.WithBatcher(exporter),
+			sdktrace.WithResource(res),
+			sdktrace.WithSampler(sdktrace.TraceIDRatioBased(cfg.SampleRatio)),
+		)
+
+		otel.SetTracerProvider(provider)
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+			propagation.TraceContext{},
+			propagation.Baggage{},
+		))
+	})
+}
+
+// routeUpstream guesses which downstream service a matched route talks to,
+// for the smart_proxy.upstream span attribute
+func routeUpstream(pathTemplate string) string {
+	if strings.Contains(pathTemplate, RuleGroupsEndpoint) {
+		return "content"
+	}
+	return "aggregator"
+}
+
+// annotateSpan adds smart-proxy specific attributes to the span that
+// otelhttp already started for the current request
+func annotateSpan(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		span := trace.SpanFromContext(request.Context())
+
+		if route := mux.CurrentRoute(request); route != nil {
+			if pathTemplate, err := route.GetPathTemplate(); err == nil {
+				span.SetAttributes(attribute.String("smart_proxy.upstream", routeUpstream(pathTemplate)))
+			}
+		}
+
+		vars := mux.Vars(request)
+		if org, ok := vars["organization"]; ok {
+			span.SetAttributes(attribute.String("smart_proxy.org_id", org))
+		}
+		if cluster, ok := vars["cluster"]; ok {
+			span.SetAttributes(attribute.String("smart_proxy.cluster_id", cluster))
+		}
+
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// tracingMiddleware wraps a matched route's handler in an otelhttp handler
+// (it is installed with router.Use, so requests that match no route get no
+// span) so every routed request gets a span named after its route template,
+// which includes the API prefix (e.g. "GET
+// /api/v1/report/{organization}/{cluster}"), carrying smart-proxy specific
+// attributes plus the eventual HTTP status code.
+func tracingMiddleware(next http.Handler) http.Handler {
+	annotated := annotateSpan(next)
+
+	return otelhttp.NewHandler(annotated, "smart-proxy", otelhttp.WithSpanNameFormatter(
+		func(operation string, request *http.Request) string {
+			if route := mux.CurrentRoute(request); route != nil {
+				if pathTemplate, err := route.GetPathTemplate(); err == nil {
+					return request.Method + " " + pathTemplate
+				}
+			}
+			return operation
+		},
+	))
+}
+
+// tracedHTTPClient returns an http.Client whose transport injects W3C
+// traceparent/baggage headers into every outbound request and records a
+// span for it, tagged with the given upstream name. proxyTo and the
+// report/full gateway fan-out use this instead of http.DefaultClient so a
+// trace links the client call, the smart-proxy hop, and the downstream
+// aggregator/content-service processing.
+func tracedHTTPClient(upstream string) *http.Client {
+	return &http.Client{
+		Transport: otelhttp.NewTransport(
+			http.DefaultTransport,
+			otelhttp.WithSpanNameFormatter(func(operation string, request *http.Request) string {
+				return upstream + " " + request.Method
+			}),
+		),
+	}
+}